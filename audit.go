@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// auditLogMaxBytes is the size at which the active audit log file is
+// rotated out to a numbered suffix.
+const auditLogMaxBytes = 10 * 1024 * 1024 // 10MB
+
+// auditLogMaxFiles bounds how many rotated files (audit.log.001, .002, ...)
+// are kept before the oldest is dropped.
+const auditLogMaxFiles = 5
+
+// AuditEvent is one structured, security-relevant log line. It's shared by
+// the audit logger and the ZAP notifier so normal audit trails and race
+// condition alerts use one schema.
+type AuditEvent struct {
+	Timestamp     time.Time `json:"timestamp"`
+	CorrelationID string    `json:"correlation_id"`
+	UserID        int       `json:"user_id"`
+	Endpoint      string    `json:"endpoint"`
+	Outcome       string    `json:"outcome"`
+	LockMode      string    `json:"lock_mode"`
+	LockAcquired  bool      `json:"lock_acquired"`
+	DurationMs    int64     `json:"duration_ms"`
+	Detail        string    `json:"detail,omitempty"`
+}
+
+// Lock modes recorded in AuditEvent.LockMode, so an incident review can tell
+// "no distributed coordination happened" (disabled) apart from "Redlock was
+// attempted and denied/failed" (redlock with LockAcquired=false).
+const (
+	lockModeDisabled = "disabled"
+	lockModeRedlock  = "redlock"
+)
+
+// AuditLogger writes AuditEvents as JSON lines to a size-rotated file and to
+// stdout.
+type AuditLogger struct {
+	mu       sync.Mutex
+	path     string
+	maxBytes int64
+	maxFiles int
+	file     *os.File
+	size     int64
+}
+
+// NewAuditLogger opens (creating if needed) the audit log file at path.
+func NewAuditLogger(path string, maxBytes int64, maxFiles int) (*AuditLogger, error) {
+	al := &AuditLogger{path: path, maxBytes: maxBytes, maxFiles: maxFiles}
+	if err := al.openCurrent(); err != nil {
+		return nil, err
+	}
+	return al, nil
+}
+
+func (al *AuditLogger) openCurrent() error {
+	f, err := os.OpenFile(al.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log %s: %w", al.path, err)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to stat audit log %s: %w", al.path, err)
+	}
+
+	al.file = f
+	al.size = info.Size()
+	return nil
+}
+
+// rotate shifts audit.log.(n-1) -> audit.log.n up to maxFiles, moves the
+// current file to audit.log.001, and opens a fresh one.
+func (al *AuditLogger) rotate() error {
+	if err := al.file.Close(); err != nil {
+		return fmt.Errorf("failed to close audit log before rotation: %w", err)
+	}
+
+	oldest := fmt.Sprintf("%s.%03d", al.path, al.maxFiles)
+	if _, err := os.Stat(oldest); err == nil {
+		if err := os.Remove(oldest); err != nil {
+			return fmt.Errorf("failed to drop oldest audit log %s: %w", oldest, err)
+		}
+	}
+
+	for n := al.maxFiles - 1; n >= 1; n-- {
+		src := fmt.Sprintf("%s.%03d", al.path, n)
+		dst := fmt.Sprintf("%s.%03d", al.path, n+1)
+		if _, err := os.Stat(src); err == nil {
+			if err := os.Rename(src, dst); err != nil {
+				return fmt.Errorf("failed to rotate %s -> %s: %w", src, dst, err)
+			}
+		}
+	}
+
+	if err := os.Rename(al.path, fmt.Sprintf("%s.%03d", al.path, 1)); err != nil {
+		return fmt.Errorf("failed to rotate active audit log: %w", err)
+	}
+
+	return al.openCurrent()
+}
+
+// Log appends event as a JSON line to the rotating file and to stdout.
+func (al *AuditLogger) Log(event AuditEvent) {
+	line, err := json.Marshal(event)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to marshal audit event: %v\n", err)
+		return
+	}
+	line = append(line, '\n')
+
+	fmt.Fprint(os.Stdout, string(line))
+
+	al.mu.Lock()
+	defer al.mu.Unlock()
+
+	if al.size+int64(len(line)) > al.maxBytes {
+		if err := al.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to rotate audit log: %v\n", err)
+		}
+	}
+
+	n, err := al.file.Write(line)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to write audit event: %v\n", err)
+		return
+	}
+	al.size += int64(n)
+}
+
+// Close flushes and closes the active audit log file.
+func (al *AuditLogger) Close() error {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	return al.file.Close()
+}
+
+var _ io.Closer = (*AuditLogger)(nil)
+
+var auditLogger *AuditLogger
+
+// requestCorrelationID reads X-Request-ID, generating one if the client
+// didn't send it, so every audit event for a request can be tied together.
+func requestCorrelationID(r *http.Request) string {
+	if id := r.Header.Get("X-Request-ID"); id != "" {
+		return id
+	}
+	return uuid.NewString()
+}
+
+type auditContextKey struct{}
+
+// auditContext carries the fields that withUserLock can't see on its own
+// (which endpoint, which correlation ID) so it can emit a complete
+// AuditEvent when the lock is acquired or denied.
+type auditContext struct {
+	CorrelationID string
+	Endpoint      string
+	UserID        int
+}
+
+func withAuditContext(ctx context.Context, ac auditContext) context.Context {
+	return context.WithValue(ctx, auditContextKey{}, ac)
+}
+
+func auditContextFromContext(ctx context.Context) auditContext {
+	ac, _ := ctx.Value(auditContextKey{}).(auditContext)
+	return ac
+}
+
+// emitHandlerAuditEvent logs a handler-level outcome (e.g. idempotency
+// rejection) that happens outside of withUserLock.
+func emitHandlerAuditEvent(ctx context.Context, userID int, outcome string, err error) {
+	if auditLogger == nil {
+		return
+	}
+
+	ac := auditContextFromContext(ctx)
+	detail := ""
+	if err != nil {
+		detail = err.Error()
+	}
+
+	auditLogger.Log(AuditEvent{
+		Timestamp:     time.Now(),
+		CorrelationID: ac.CorrelationID,
+		UserID:        userID,
+		Endpoint:      ac.Endpoint,
+		Outcome:       outcome,
+		Detail:        detail,
+	})
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAuditLoggerRotateShiftsFilesAndOpensFresh(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.log")
+
+	al, err := NewAuditLogger(path, 1024, 2)
+	if err != nil {
+		t.Fatalf("NewAuditLogger failed: %v", err)
+	}
+	defer al.Close()
+
+	if err := os.WriteFile(path+".001", []byte("oldest-gen1\n"), 0644); err != nil {
+		t.Fatalf("failed to seed %s.001: %v", path, err)
+	}
+	if _, err := al.file.WriteString("current-active\n"); err != nil {
+		t.Fatalf("failed to seed active file: %v", err)
+	}
+
+	if err := al.rotate(); err != nil {
+		t.Fatalf("rotate failed: %v", err)
+	}
+
+	gen1, err := os.ReadFile(path + ".001")
+	if err != nil {
+		t.Fatalf("expected %s.001 to exist after rotation: %v", path, err)
+	}
+	if string(gen1) != "current-active\n" {
+		t.Fatalf("expected %s.001 to hold the previously-active content, got %q", path, gen1)
+	}
+
+	gen2, err := os.ReadFile(path + ".002")
+	if err != nil {
+		t.Fatalf("expected %s.002 to exist after rotation: %v", path, err)
+	}
+	if string(gen2) != "oldest-gen1\n" {
+		t.Fatalf("expected %s.002 to hold what was previously .001, got %q", path, gen2)
+	}
+
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("expected a fresh active file to be opened at %s: %v", path, err)
+	}
+
+	al.Log(AuditEvent{Outcome: "test"})
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read fresh active file: %v", err)
+	}
+	if len(data) == 0 {
+		t.Fatalf("expected the fresh active file to receive subsequent writes")
+	}
+}
+
+func TestAuditLoggerRotateDropsOldestBeyondMaxFiles(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.log")
+
+	al, err := NewAuditLogger(path, 1024, 1)
+	if err != nil {
+		t.Fatalf("NewAuditLogger failed: %v", err)
+	}
+	defer al.Close()
+
+	if err := os.WriteFile(path+".001", []byte("should-be-dropped\n"), 0644); err != nil {
+		t.Fatalf("failed to seed %s.001: %v", path, err)
+	}
+
+	if err := al.rotate(); err != nil {
+		t.Fatalf("rotate failed: %v", err)
+	}
+
+	data, err := os.ReadFile(path + ".001")
+	if err != nil {
+		t.Fatalf("expected %s.001 to exist after rotation: %v", path, err)
+	}
+	if string(data) == "should-be-dropped\n" {
+		t.Fatalf("expected the oldest generation to be dropped once maxFiles=1 was exceeded")
+	}
+}
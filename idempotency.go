@@ -0,0 +1,271 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// idempotencyTTL задаёт время жизни записи о выполненном запросе.
+const idempotencyTTL = 24 * time.Hour
+
+// idempotencyReservationTTL задаёт время жизни placeholder'а "запрос ещё
+// выполняется" (StatusCode == 0). Она намного короче idempotencyTTL: если
+// обработчик упадёт между reserve и store/release (паника, OOM-kill,
+// рестарт деплоя), placeholder сам "сгорит" за секунды, а не будет висеть
+// и отклонять легитимные ретраи почти сутки.
+const idempotencyReservationTTL = 30 * time.Second
+
+// idempotencyCacheCapacity ограничивает размер in-process fallback-кэша,
+// когда Redis недоступен.
+const idempotencyCacheCapacity = 10000
+
+// idempotencyRecord — то, что кладётся в кэш (Redis или in-process) по ключу
+// идемпотентности: хэш исходного запроса и уже посчитанный ответ.
+type idempotencyRecord struct {
+	RequestHash string   `json:"request_hash"`
+	StatusCode  int      `json:"status_code"`
+	Response    Response `json:"response"`
+}
+
+// idempotencyOutcome описывает, что нужно сделать с запросом после проверки
+// кэша реплеев.
+type idempotencyOutcome int
+
+const (
+	idempotencyProceed idempotencyOutcome = iota
+	idempotencyReplay
+	idempotencyConflict
+)
+
+// localIdempotencyCache — простой LRU с TTL на запись, используется вместо
+// Redis, когда redisEnabled == false. Гарантирует дедупликацию реплеев в
+// рамках одного инстанса.
+type localIdempotencyCache struct {
+	mu       sync.Mutex
+	capacity int
+	ll       *list.List
+	items    map[string]*list.Element
+}
+
+type localIdempotencyEntry struct {
+	key       string
+	record    idempotencyRecord
+	expiresAt time.Time
+}
+
+func newLocalIdempotencyCache(capacity int) *localIdempotencyCache {
+	return &localIdempotencyCache{
+		capacity: capacity,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+func (c *localIdempotencyCache) get(key string) (idempotencyRecord, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		return idempotencyRecord{}, false
+	}
+
+	entry := el.Value.(*localIdempotencyEntry)
+	if time.Now().After(entry.expiresAt) {
+		c.ll.Remove(el)
+		delete(c.items, key)
+		return idempotencyRecord{}, false
+	}
+
+	c.ll.MoveToFront(el)
+	return entry.record, true
+}
+
+func (c *localIdempotencyCache) putIfAbsent(key string, record idempotencyRecord, ttl time.Duration) (idempotencyRecord, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		entry := el.Value.(*localIdempotencyEntry)
+		if time.Now().Before(entry.expiresAt) {
+			c.ll.MoveToFront(el)
+			return entry.record, false
+		}
+		c.ll.Remove(el)
+		delete(c.items, key)
+	}
+
+	c.insertLocked(key, record, ttl)
+	return record, true
+}
+
+// put unconditionally writes record under key with the given ttl,
+// overwriting whatever was there (including a pending reservation from
+// putIfAbsent). Mirrors what Redis's SET does for idempotencyStore's Redis
+// path.
+func (c *localIdempotencyCache) put(key string, record idempotencyRecord, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		entry := el.Value.(*localIdempotencyEntry)
+		entry.record = record
+		entry.expiresAt = time.Now().Add(ttl)
+		c.ll.MoveToFront(el)
+		return
+	}
+
+	c.insertLocked(key, record, ttl)
+}
+
+// insertLocked adds a brand-new entry for key with the given ttl and evicts
+// from the back until capacity is satisfied again. Callers must hold c.mu
+// and must already know key isn't present.
+func (c *localIdempotencyCache) insertLocked(key string, record idempotencyRecord, ttl time.Duration) {
+	entry := &localIdempotencyEntry{key: key, record: record, expiresAt: time.Now().Add(ttl)}
+	el := c.ll.PushFront(entry)
+	c.items[key] = el
+
+	for c.ll.Len() > c.capacity {
+		oldest := c.ll.Back()
+		if oldest == nil {
+			break
+		}
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(*localIdempotencyEntry).key)
+	}
+}
+
+// delete drops key's reservation/record, e.g. so a request that ultimately
+// failed doesn't leave a stuck placeholder behind for the rest of the TTL.
+func (c *localIdempotencyCache) delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		c.ll.Remove(el)
+		delete(c.items, key)
+	}
+}
+
+var idemCache = newLocalIdempotencyCache(idempotencyCacheCapacity)
+
+func hashRequestBody(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// idempotencyCheck смотрит, не обрабатывался ли уже запрос с таким
+// Idempotency-Key. Если обрабатывался с тем же телом — возвращает закэшированный
+// ответ (idempotencyReplay). Если с другим телом — idempotencyConflict.
+// Если ключа нет — idempotencyProceed, и вызывающая сторона обязана затем
+// вызвать idempotencyStore с результатом.
+func idempotencyCheck(ctx context.Context, key string, userID int, body []byte) (idempotencyOutcome, idempotencyRecord, error) {
+	hash := hashRequestBody(body)
+	cacheKey := fmt.Sprintf("idempotency:user:%d:%s", userID, key)
+
+	if !redisEnabled {
+		// putIfAbsent reserves the key the same way Redis's SETNX does below:
+		// only the first concurrent caller gets inserted=true and proceeds,
+		// so two in-flight retries can't both slip past this check and run
+		// applyLedgerEntry twice.
+		placeholder := idempotencyRecord{RequestHash: hash}
+		existing, inserted := idemCache.putIfAbsent(cacheKey, placeholder, idempotencyReservationTTL)
+		if inserted {
+			return idempotencyProceed, idempotencyRecord{}, nil
+		}
+		if existing.RequestHash != hash {
+			return idempotencyConflict, idempotencyRecord{}, nil
+		}
+		if existing.StatusCode == 0 {
+			// Запрос ещё выполняется в другой горутине, ответ не готов.
+			return idempotencyConflict, idempotencyRecord{}, fmt.Errorf("request with this idempotency key is still in flight")
+		}
+		return idempotencyReplay, existing, nil
+	}
+
+	placeholder := idempotencyRecord{RequestHash: hash}
+	payload, err := json.Marshal(placeholder)
+	if err != nil {
+		return idempotencyProceed, idempotencyRecord{}, fmt.Errorf("failed to marshal idempotency placeholder: %w", err)
+	}
+
+	ok, err := redisClient.SetNX(ctx, cacheKey, payload, idempotencyReservationTTL).Result()
+	if err != nil {
+		return idempotencyProceed, idempotencyRecord{}, fmt.Errorf("failed to reserve idempotency key: %w", err)
+	}
+	if ok {
+		// Мы первые — выполняем запрос как обычно, ответ сохранит idempotencyStore.
+		return idempotencyProceed, idempotencyRecord{}, nil
+	}
+
+	raw, err := redisClient.Get(ctx, cacheKey).Bytes()
+	if err != nil {
+		return idempotencyProceed, idempotencyRecord{}, fmt.Errorf("failed to read idempotency record: %w", err)
+	}
+
+	var existing idempotencyRecord
+	if err := json.Unmarshal(raw, &existing); err != nil {
+		return idempotencyProceed, idempotencyRecord{}, fmt.Errorf("failed to unmarshal idempotency record: %w", err)
+	}
+
+	if existing.RequestHash != hash {
+		return idempotencyConflict, idempotencyRecord{}, nil
+	}
+	if existing.StatusCode == 0 {
+		// Запрос ещё выполняется в другой горутине/инстансе, ответ не готов.
+		return idempotencyConflict, idempotencyRecord{}, fmt.Errorf("request with this idempotency key is still in flight")
+	}
+
+	return idempotencyReplay, existing, nil
+}
+
+// idempotencyStore фиксирует финальный результат запроса под ключом
+// идемпотентности, чтобы последующие реплеи вернули его без повторного
+// выполнения бизнес-логики.
+func idempotencyStore(ctx context.Context, key string, userID int, body []byte, statusCode int, resp Response) error {
+	hash := hashRequestBody(body)
+	cacheKey := fmt.Sprintf("idempotency:user:%d:%s", userID, key)
+	record := idempotencyRecord{RequestHash: hash, StatusCode: statusCode, Response: resp}
+
+	if !redisEnabled {
+		idemCache.put(cacheKey, record, idempotencyTTL)
+		return nil
+	}
+
+	payload, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal idempotency record: %w", err)
+	}
+
+	if err := redisClient.Set(ctx, cacheKey, payload, idempotencyTTL).Err(); err != nil {
+		return fmt.Errorf("failed to persist idempotency record: %w", err)
+	}
+	return nil
+}
+
+// idempotencyRelease drops a reservation made by idempotencyCheck without
+// ever calling idempotencyStore, e.g. because the wrapped business logic
+// failed. Without this, a failed request's SETNX/putIfAbsent placeholder
+// would sit there for the rest of idempotencyReservationTTL, so even a legitimate retry
+// of the same request would be rejected as idempotencyConflict instead of
+// being allowed to actually run.
+func idempotencyRelease(ctx context.Context, key string, userID int) error {
+	cacheKey := fmt.Sprintf("idempotency:user:%d:%s", userID, key)
+
+	if !redisEnabled {
+		idemCache.delete(cacheKey)
+		return nil
+	}
+
+	if err := redisClient.Del(ctx, cacheKey).Err(); err != nil {
+		return fmt.Errorf("failed to release idempotency key: %w", err)
+	}
+	return nil
+}
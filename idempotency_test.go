@@ -0,0 +1,121 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLocalIdempotencyCacheEvictsOldestOverCapacity(t *testing.T) {
+	c := newLocalIdempotencyCache(2)
+
+	c.put("a", idempotencyRecord{StatusCode: 200}, idempotencyTTL)
+	c.put("b", idempotencyRecord{StatusCode: 200}, idempotencyTTL)
+	c.put("c", idempotencyRecord{StatusCode: 200}, idempotencyTTL)
+
+	if _, ok := c.get("a"); ok {
+		t.Fatalf("expected oldest entry \"a\" to be evicted once capacity was exceeded")
+	}
+	if _, ok := c.get("b"); !ok {
+		t.Fatalf("expected \"b\" to still be cached")
+	}
+	if _, ok := c.get("c"); !ok {
+		t.Fatalf("expected \"c\" to still be cached")
+	}
+}
+
+func TestLocalIdempotencyCacheGetTouchesRecency(t *testing.T) {
+	c := newLocalIdempotencyCache(2)
+
+	c.put("a", idempotencyRecord{StatusCode: 200}, idempotencyTTL)
+	c.put("b", idempotencyRecord{StatusCode: 200}, idempotencyTTL)
+	c.get("a") // "a" is now more recently used than "b"
+	c.put("c", idempotencyRecord{StatusCode: 200}, idempotencyTTL)
+
+	if _, ok := c.get("b"); ok {
+		t.Fatalf("expected \"b\" (least recently used) to be evicted, not \"a\"")
+	}
+	if _, ok := c.get("a"); !ok {
+		t.Fatalf("expected \"a\" to survive eviction after being touched by get")
+	}
+}
+
+func TestLocalIdempotencyCacheExpiresByTTL(t *testing.T) {
+	c := newLocalIdempotencyCache(10)
+
+	c.put("a", idempotencyRecord{StatusCode: 200}, time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+
+	if _, ok := c.get("a"); ok {
+		t.Fatalf("expected expired entry to be absent")
+	}
+}
+
+func TestLocalIdempotencyCachePutIfAbsentReservesOnce(t *testing.T) {
+	c := newLocalIdempotencyCache(10)
+
+	record := idempotencyRecord{RequestHash: "hash1"}
+	_, inserted := c.putIfAbsent("key", record, idempotencyReservationTTL)
+	if !inserted {
+		t.Fatalf("expected first putIfAbsent to insert")
+	}
+
+	existing, inserted := c.putIfAbsent("key", record, idempotencyReservationTTL)
+	if inserted {
+		t.Fatalf("expected second putIfAbsent for the same key to not insert")
+	}
+	if existing.RequestHash != record.RequestHash {
+		t.Fatalf("expected existing reservation to be returned, got %+v", existing)
+	}
+}
+
+func TestLocalIdempotencyCacheReservationSelfHealsAfterLease(t *testing.T) {
+	c := newLocalIdempotencyCache(10)
+
+	placeholder := idempotencyRecord{RequestHash: "hash1"}
+	if _, inserted := c.putIfAbsent("key", placeholder, time.Millisecond); !inserted {
+		t.Fatalf("expected reservation to be inserted")
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	// Simulates a request that crashed between reserving and storing/
+	// releasing: the short reservation lease should let a later retry
+	// reserve again instead of being stuck in idempotencyConflict for the
+	// rest of idempotencyTTL.
+	_, inserted := c.putIfAbsent("key", placeholder, idempotencyReservationTTL)
+	if !inserted {
+		t.Fatalf("expected expired reservation to self-heal, allowing a fresh reservation")
+	}
+}
+
+// TestIdempotencyCheckConcurrentRetriesOnlyOneProceeds reproduces the
+// double-withdraw race this series fixes: many concurrent requests reusing
+// the same Idempotency-Key and body must have exactly one of them see
+// idempotencyProceed; the rest must see idempotencyConflict (still in
+// flight) until the winner calls idempotencyStore.
+func TestIdempotencyCheckConcurrentRetriesOnlyOneProceeds(t *testing.T) {
+	idemCache = newLocalIdempotencyCache(idempotencyCacheCapacity)
+	defer func() { idemCache = newLocalIdempotencyCache(idempotencyCacheCapacity) }()
+
+	const n = 50
+	body := []byte(`{"user_id":1,"amount":10}`)
+
+	var proceedCount int32
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer wg.Done()
+			outcome, _, _ := idempotencyCheck(nil, "same-key", 1, body)
+			if outcome == idempotencyProceed {
+				atomic.AddInt32(&proceedCount, 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if proceedCount != 1 {
+		t.Fatalf("expected exactly 1 request to proceed, got %d", proceedCount)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Account is the balance snapshot for a single user, kept in sync with the
+// transactions ledger so reads are O(1) instead of re-summing history.
+type Account struct {
+	UserID  int     `json:"user_id"`
+	Balance float64 `json:"balance"`
+}
+
+// initAccountsTable creates the accounts table if it doesn't exist yet. It
+// holds one row per user with the current balance and a version column that
+// is incremented on every update, updated transactionally alongside every
+// ledger entry.
+func initAccountsTable() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var tableExists bool
+	err := db.QueryRowContext(ctx, `
+        SELECT EXISTS (
+            SELECT FROM information_schema.tables
+            WHERE table_schema = 'public'
+            AND table_name = 'accounts'
+        )
+    `).Scan(&tableExists)
+
+	if err != nil {
+		return fmt.Errorf("failed to check accounts table existence: %w", err)
+	}
+
+	if !tableExists {
+		log.Println("Creating accounts table...")
+
+		createTableSQL := `
+        CREATE TABLE accounts (
+            user_id INTEGER PRIMARY KEY,
+            balance DECIMAL(14, 2) NOT NULL DEFAULT 0,
+            version INTEGER NOT NULL DEFAULT 0
+        );
+        `
+
+		_, err := db.ExecContext(ctx, createTableSQL)
+		if err != nil {
+			return fmt.Errorf("failed to create accounts table: %w", err)
+		}
+		log.Println("Accounts table created")
+	} else {
+		log.Println("Accounts table already exists")
+	}
+
+	return nil
+}
+
+// applyLedgerEntry performs one deposit/withdraw atomically against the
+// accounts snapshot: it locks the account row with SELECT ... FOR UPDATE,
+// validates the balance for withdrawals, updates the snapshot and appends
+// the transactions row, all inside a single DB transaction. withUserLock is
+// kept as an outer coordination layer, but this row lock is what actually
+// guarantees correctness when redisEnabled is false.
+func applyLedgerEntry(ctx context.Context, userID int, amount float64, operationType string) (float64, error) {
+	dbTx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() {
+		_ = dbTx.Rollback()
+	}()
+
+	if _, err := dbTx.ExecContext(ctx,
+		"INSERT INTO accounts (user_id, balance, version) VALUES ($1, 0, 0) ON CONFLICT (user_id) DO NOTHING",
+		userID,
+	); err != nil {
+		return 0, fmt.Errorf("failed to ensure account row: %w", err)
+	}
+
+	var balance float64
+	var version int
+	err = dbTx.QueryRowContext(ctx,
+		"SELECT balance, version FROM accounts WHERE user_id = $1 FOR UPDATE",
+		userID,
+	).Scan(&balance, &version)
+	if err != nil {
+		return 0, fmt.Errorf("failed to lock account: %w", err)
+	}
+
+	switch operationType {
+	case "DEPOSIT":
+		balance += amount
+	case "WITHDRAW":
+		if balance < amount {
+			return 0, fmt.Errorf("insufficient funds: balance=%.2f, withdraw=%.2f", balance, amount)
+		}
+		balance -= amount
+	default:
+		return 0, fmt.Errorf("unknown operation type: %s", operationType)
+	}
+
+	if _, err := dbTx.ExecContext(ctx,
+		"UPDATE accounts SET balance = $1, version = version + 1 WHERE user_id = $2",
+		balance, userID,
+	); err != nil {
+		return 0, fmt.Errorf("failed to update account balance: %w", err)
+	}
+
+	if _, err := dbTx.ExecContext(ctx,
+		"INSERT INTO transactions (user_id, amount, operation_type) VALUES ($1, $2, $3)",
+		userID, amount, operationType,
+	); err != nil {
+		return 0, fmt.Errorf("failed to record transaction: %w", err)
+	}
+
+	if redisEnabled {
+		if err := insertOutboxEvent(ctx, dbTx, userID, operationType, amount, balance); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := dbTx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return balance, nil
+}
+
+// balanceHandler serves GET /api/balance?user_id=, reading the O(1) snapshot
+// from accounts instead of summing the full transactions history.
+func balanceHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userIDStr := r.URL.Query().Get("user_id")
+	if userIDStr == "" {
+		http.Error(w, "user_id query parameter is required", http.StatusBadRequest)
+		return
+	}
+
+	userID, err := strconv.Atoi(userIDStr)
+	if err != nil {
+		http.Error(w, "user_id must be an integer", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	var balance float64
+	err = db.QueryRowContext(ctx, "SELECT balance FROM accounts WHERE user_id = $1", userID).Scan(&balance)
+	if errors.Is(err, sql.ErrNoRows) {
+		balance = 0
+	} else if err != nil {
+		log.Printf("balance lookup error: %v\n", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSONResponse(w, http.StatusOK, Account{UserID: userID, Balance: balance})
+}
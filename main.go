@@ -7,11 +7,13 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"math/rand"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/bsm/redislock"
@@ -26,16 +28,19 @@ var (
 	port int
 	db   *sql.DB
 
-	redisClient  *redis.Client
+	redisClient  redis.UniversalClient
 	locker       *redislock.Client
 	redisEnabled bool
 
+	zapNotifier *ZAPNotifier
+
 	metrics = struct {
 		counter     prometheus.Counter
 		gauge       prometheus.Gauge
 		histogram   prometheus.Histogram
 		summary     prometheus.Summary
 		requestTime *prometheus.HistogramVec
+		rateLimited *prometheus.CounterVec
 	}{
 		counter: prometheus.NewCounter(
 			prometheus.CounterOpts{
@@ -172,10 +177,26 @@ func connectDB() error {
 	return nil
 }
 
+// splitAddrs splits a comma-separated list of host:port pairs, trimming
+// whitespace and dropping empty entries.
+func splitAddrs(s string) []string {
+	var addrs []string
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part != "" {
+			addrs = append(addrs, part)
+		}
+	}
+	return addrs
+}
+
+// connectRedis builds redisClient from REDIS_MODE ("single" by default,
+// "sentinel" or "cluster"), so withUserLock transparently gets Redlock
+// across whatever HA topology is actually deployed in front of it.
 func connectRedis() error {
-	addr := os.Getenv("REDIS_ADDR")
-	if addr == "" {
-		addr = "localhost:6379"
+	mode := os.Getenv("REDIS_MODE")
+	if mode == "" {
+		mode = "single"
 	}
 
 	dbNum := 0
@@ -185,13 +206,57 @@ func connectRedis() error {
 		}
 	}
 
-	password := os.Getenv("REDIS_PASSWORD")
+	var description string
 
-	redisClient = redis.NewClient(&redis.Options{
-		Addr:     addr,
-		Password: password,
-		DB:       dbNum,
-	})
+	switch mode {
+	case "single":
+		addr := os.Getenv("REDIS_ADDR")
+		if addr == "" {
+			addr = "localhost:6379"
+		}
+		password := os.Getenv("REDIS_PASSWORD")
+
+		redisClient = redis.NewClient(&redis.Options{
+			Addr:     addr,
+			Password: password,
+			DB:       dbNum,
+		})
+		description = fmt.Sprintf("single node %s DB=%d", addr, dbNum)
+
+	case "sentinel":
+		sentinelAddrs := splitAddrs(os.Getenv("REDIS_SENTINEL_ADDRS"))
+		if len(sentinelAddrs) == 0 {
+			return fmt.Errorf("REDIS_SENTINEL_ADDRS is required when REDIS_MODE=sentinel")
+		}
+		masterName := os.Getenv("REDIS_SENTINEL_MASTER")
+		if masterName == "" {
+			return fmt.Errorf("REDIS_SENTINEL_MASTER is required when REDIS_MODE=sentinel")
+		}
+
+		redisClient = redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:       masterName,
+			SentinelAddrs:    sentinelAddrs,
+			SentinelPassword: os.Getenv("REDIS_SENTINEL_PASSWORD"),
+			Password:         os.Getenv("REDIS_PASSWORD"),
+			DB:               dbNum,
+		})
+		description = fmt.Sprintf("sentinel master=%s addrs=%v DB=%d", masterName, sentinelAddrs, dbNum)
+
+	case "cluster":
+		clusterAddrs := splitAddrs(os.Getenv("REDIS_CLUSTER_ADDRS"))
+		if len(clusterAddrs) == 0 {
+			return fmt.Errorf("REDIS_CLUSTER_ADDRS is required when REDIS_MODE=cluster")
+		}
+
+		redisClient = redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:    clusterAddrs,
+			Password: os.Getenv("REDIS_PASSWORD"),
+		})
+		description = fmt.Sprintf("cluster addrs=%v", clusterAddrs)
+
+	default:
+		return fmt.Errorf("unknown REDIS_MODE %q (expected single, sentinel or cluster)", mode)
+	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
@@ -202,7 +267,7 @@ func connectRedis() error {
 
 	locker = redislock.New(redisClient)
 
-	log.Printf("Redis connection established to %s DB=%d\n", addr, dbNum)
+	log.Printf("Redis connection established (%s mode): %s\n", mode, description)
 	return nil
 }
 
@@ -212,8 +277,14 @@ func depositHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
 	var tx Transaction
-	if err := json.NewDecoder(r.Body).Decode(&tx); err != nil {
+	if err := json.Unmarshal(body, &tx); err != nil {
 		http.Error(w, "Invalid request", http.StatusBadRequest)
 		return
 	}
@@ -225,16 +296,35 @@ func depositHandler(w http.ResponseWriter, r *http.Request) {
 
 	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
 	defer cancel()
+	ctx = withAuditContext(ctx, auditContext{
+		CorrelationID: requestCorrelationID(r),
+		Endpoint:      "/api/deposit",
+		UserID:        tx.UserID,
+	})
 
-	err := withUserLock(ctx, tx.UserID, func(ctx context.Context) error {
-		// Здесь я могу делать всё, что должно быть атомарным
-		_, err := db.ExecContext(
-			ctx,
-			"INSERT INTO transactions (user_id, amount, operation_type) VALUES ($1, $2, 'DEPOSIT')",
-			tx.UserID,
-			tx.Amount,
-		)
+	idemKey := r.Header.Get("Idempotency-Key")
+	if idemKey != "" {
+		outcome, cached, err := idempotencyCheck(ctx, idemKey, tx.UserID, body)
+		if err != nil {
+			emitHandlerAuditEvent(ctx, tx.UserID, "idempotency_error", err)
+			http.Error(w, "Conflict or database error", http.StatusConflict)
+			return
+		}
+		switch outcome {
+		case idempotencyReplay:
+			writeJSONResponse(w, cached.StatusCode, cached.Response)
+			return
+		case idempotencyConflict:
+			http.Error(w, "Idempotency key reused with a different request", http.StatusConflict)
+			return
+		}
+	}
 
+	err = withUserLock(ctx, tx.UserID, func(ctx context.Context) error {
+		// withUserLock координирует конкурентных клиентов, но безопасность
+		// обеспечивает SELECT ... FOR UPDATE внутри applyLedgerEntry — она не
+		// зависит от того, включён ли Redis.
+		_, err := applyLedgerEntry(ctx, tx.UserID, tx.Amount, "DEPOSIT")
 		if err != nil {
 			return fmt.Errorf("database error (deposit): %w", err)
 		}
@@ -243,16 +333,29 @@ func depositHandler(w http.ResponseWriter, r *http.Request) {
 	})
 
 	if err != nil {
-		log.Printf("deposit error: %v\n", err)
-		// Стоит ли различать ошибки блокировки и бизнес-ошибки?
+		if idemKey != "" {
+			releaseCtx, releaseCancel := context.WithTimeout(context.Background(), 5*time.Second)
+			if releaseErr := idempotencyRelease(releaseCtx, idemKey, tx.UserID); releaseErr != nil {
+				emitHandlerAuditEvent(ctx, tx.UserID, "idempotency_release_failed", releaseErr)
+			}
+			releaseCancel()
+		}
 		http.Error(w, "Conflict or database error", http.StatusConflict)
 		return
 	}
 
-	writeJSONResponse(w, http.StatusOK, Response{
+	resp := Response{
 		Status:  "success",
 		Message: fmt.Sprintf("Deposited %.2f to user %d", tx.Amount, tx.UserID),
-	})
+	}
+
+	if idemKey != "" {
+		if err := idempotencyStore(ctx, idemKey, tx.UserID, body, http.StatusOK, resp); err != nil {
+			emitHandlerAuditEvent(ctx, tx.UserID, "idempotency_store_failed", err)
+		}
+	}
+
+	writeJSONResponse(w, http.StatusOK, resp)
 }
 
 func withdrawHandler(w http.ResponseWriter, r *http.Request) {
@@ -261,8 +364,14 @@ func withdrawHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
 	var tx Transaction
-	if err := json.NewDecoder(r.Body).Decode(&tx); err != nil {
+	if err := json.Unmarshal(body, &tx); err != nil {
 		http.Error(w, "Invalid request", http.StatusBadRequest)
 		return
 	}
@@ -274,63 +383,86 @@ func withdrawHandler(w http.ResponseWriter, r *http.Request) {
 
 	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
 	defer cancel()
+	ctx = withAuditContext(ctx, auditContext{
+		CorrelationID: requestCorrelationID(r),
+		Endpoint:      "/api/withdraw",
+		UserID:        tx.UserID,
+	})
 
-	err := withUserLock(ctx, tx.UserID, func(ctx context.Context) error {
-		// Проверка баланса (работает как с Redis, так и без)
-		var balance float64
-		row := db.QueryRowContext(ctx, `
-            SELECT COALESCE(SUM(
-                CASE WHEN operation_type = 'DEPOSIT' THEN amount
-                     WHEN operation_type = 'WITHDRAW' THEN -amount
-                END
-            ), 0) AS balance
-            FROM transactions
-            WHERE user_id = $1
-        `, tx.UserID)
-
-		if err := row.Scan(&balance); err != nil {
-			return fmt.Errorf("failed to get balance: %w", err)
+	idemKey := r.Header.Get("Idempotency-Key")
+	if idemKey != "" {
+		outcome, cached, err := idempotencyCheck(ctx, idemKey, tx.UserID, body)
+		if err != nil {
+			emitHandlerAuditEvent(ctx, tx.UserID, "idempotency_error", err)
+			http.Error(w, "Conflict or database error", http.StatusConflict)
+			return
 		}
-
-		if balance < tx.Amount {
-			return fmt.Errorf("insufficient funds: balance=%.2f, withdraw=%.2f", balance, tx.Amount)
+		switch outcome {
+		case idempotencyReplay:
+			writeJSONResponse(w, cached.StatusCode, cached.Response)
+			return
+		case idempotencyConflict:
+			http.Error(w, "Idempotency key reused with a different request", http.StatusConflict)
+			return
 		}
+	}
 
-		_, err := db.ExecContext(
-			ctx,
-			"INSERT INTO transactions (user_id, amount, operation_type) VALUES ($1, $2, 'WITHDRAW')",
-			tx.UserID,
-			tx.Amount,
-		)
+	err = withUserLock(ctx, tx.UserID, func(ctx context.Context) error {
+		// withUserLock координирует конкурентных клиентов через Redlock, но
+		// SELECT ... FOR UPDATE внутри applyLedgerEntry — это то, что реально
+		// гарантирует корректность при отключённом Redis.
+		_, err := applyLedgerEntry(ctx, tx.UserID, tx.Amount, "WITHDRAW")
 		if err != nil {
-			return fmt.Errorf("database error (withdraw): %w", err)
+			return err
 		}
 
 		return nil
 	})
 
 	if err != nil {
-		log.Printf("withdraw error: %v\n", err)
-		// Стоит ли различать ошибки блокировки и бизнес-ошибки?
+		if idemKey != "" {
+			releaseCtx, releaseCancel := context.WithTimeout(context.Background(), 5*time.Second)
+			if releaseErr := idempotencyRelease(releaseCtx, idemKey, tx.UserID); releaseErr != nil {
+				emitHandlerAuditEvent(ctx, tx.UserID, "idempotency_release_failed", releaseErr)
+			}
+			releaseCancel()
+		}
 		http.Error(w, err.Error(), http.StatusConflict)
 		return
 	}
 
-	writeJSONResponse(w, http.StatusOK, Response{
+	resp := Response{
 		Status:  "success",
 		Message: fmt.Sprintf("Withdrawn %.2f from user %d", tx.Amount, tx.UserID),
-	})
+	}
+
+	if idemKey != "" {
+		if err := idempotencyStore(ctx, idemKey, tx.UserID, body, http.StatusOK, resp); err != nil {
+			emitHandlerAuditEvent(ctx, tx.UserID, "idempotency_store_failed", err)
+		}
+	}
+
+	writeJSONResponse(w, http.StatusOK, resp)
 }
 
 func withUserLock(ctx context.Context, userID int, fn func(ctx context.Context) error) error {
-	// Если Redis отключен, просто выполняем функцию без блокировки
+	ac := auditContextFromContext(ctx)
+	start := time.Now()
+
+	// Если Redis отключен, просто выполняем функцию без блокировки — никакой
+	// блокировки не было, поэтому lockAcquired=false, а lockMode отличает этот
+	// случай от honest Redlock denial.
 	if !redisEnabled {
-		return fn(ctx)
+		err := fn(ctx)
+		emitLockAuditEvent(ac, userID, lockModeDisabled, false, start, err)
+		return err
 	}
 
 	// Если Redis включен, используем Redlock
 	if locker == nil {
-		return fmt.Errorf("locker is not initialized")
+		err := fmt.Errorf("locker is not initialized")
+		emitLockAuditEvent(ac, userID, lockModeRedlock, false, start, err)
+		return err
 	}
 
 	key := fmt.Sprintf("lock:user:%d", userID)
@@ -342,20 +474,74 @@ func withUserLock(ctx context.Context, userID int, fn func(ctx context.Context)
 		RetryStrategy: redislock.LinearBackoff(100 * time.Millisecond),
 	})
 	if errors.Is(err, redislock.ErrNotObtained) {
-		return fmt.Errorf("could not obtain lock for user %d", userID)
+		lockErr := fmt.Errorf("could not obtain lock for user %d", userID)
+		emitLockAuditEvent(ac, userID, lockModeRedlock, false, start, lockErr)
+		if zapNotifier != nil {
+			zapNotifier.NotifyRaceConditionPrevented(userID, ac.Endpoint, "POST", map[string]interface{}{
+				"correlation_id": ac.CorrelationID,
+			})
+		}
+		return lockErr
 	}
 	if err != nil {
-		return fmt.Errorf("failed to obtain lock: %w", err)
+		wrapped := fmt.Errorf("failed to obtain lock: %w", err)
+		emitLockAuditEvent(ac, userID, lockModeRedlock, false, start, wrapped)
+		return wrapped
 	}
 
 	defer func() {
 		if err := lock.Release(ctx); err != nil {
-			log.Printf("failed to release lock for user %d: %v", userID, err)
+			if auditLogger != nil {
+				auditLogger.Log(AuditEvent{
+					Timestamp:     time.Now(),
+					CorrelationID: ac.CorrelationID,
+					UserID:        userID,
+					Endpoint:      ac.Endpoint,
+					Outcome:       "lock_release_failed",
+					LockMode:      lockModeRedlock,
+					LockAcquired:  true,
+					DurationMs:    time.Since(start).Milliseconds(),
+					Detail:        err.Error(),
+				})
+			}
 		}
 	}()
 
 	// Выполняем критическую секцию
-	return fn(ctx)
+	err = fn(ctx)
+	emitLockAuditEvent(ac, userID, lockModeRedlock, true, start, err)
+	return err
+}
+
+// emitLockAuditEvent logs the outcome of a withUserLock call (acquired or
+// denied, and whether the wrapped fn succeeded) as one structured event.
+// lockMode records whether Redlock was even attempted (lockModeRedlock) or
+// locking was skipped entirely (lockModeDisabled), so lockAcquired=false
+// means something different in each case — no lock attempted vs. Redlock
+// denied/failed.
+func emitLockAuditEvent(ac auditContext, userID int, lockMode string, lockAcquired bool, start time.Time, err error) {
+	if auditLogger == nil {
+		return
+	}
+
+	outcome := "success"
+	detail := ""
+	if err != nil {
+		outcome = "error"
+		detail = err.Error()
+	}
+
+	auditLogger.Log(AuditEvent{
+		Timestamp:     time.Now(),
+		CorrelationID: ac.CorrelationID,
+		UserID:        userID,
+		Endpoint:      ac.Endpoint,
+		Outcome:       outcome,
+		LockMode:      lockMode,
+		LockAcquired:  lockAcquired,
+		DurationMs:    time.Since(start).Milliseconds(),
+		Detail:        detail,
+	})
 }
 
 func newHandlerWithHistogram(handler http.Handler, histogram *prometheus.HistogramVec) http.Handler {
@@ -400,6 +586,23 @@ func main() {
 	log.Println("=== Starting Balance Microservice v2.1 ===")
 	flag.Parse()
 
+	logPath := os.Getenv("AUDIT_LOG_PATH")
+	if logPath == "" {
+		logPath = "audit.log"
+	}
+	var err error
+	auditLogger, err = NewAuditLogger(logPath, auditLogMaxBytes, auditLogMaxFiles)
+	if err != nil {
+		log.Fatalf("Failed to initialize audit logger: %v\n", err)
+	}
+	defer func() {
+		if err := auditLogger.Close(); err != nil {
+			log.Printf("Error closing audit logger: %v", err)
+		}
+	}()
+
+	zapNotifier = NewZAPNotifier()
+
 	if err := connectDB(); err != nil {
 		log.Fatalf("Failed to initialize database: %v\n", err)
 	}
@@ -431,6 +634,22 @@ func main() {
 		log.Println("Continuing without table initialization...")
 	}
 
+	if err := initAccountsTable(); err != nil {
+		log.Printf("Warning: Failed to initialize accounts table: %v\n", err)
+		log.Println("Continuing without accounts table initialization...")
+	}
+
+	if redisEnabled {
+		if err := initOutboxTable(); err != nil {
+			log.Printf("Warning: Failed to initialize outbox_events table: %v\n", err)
+			log.Println("Continuing without outbox table initialization...")
+		} else {
+			outboxCtx, cancelOutbox := context.WithCancel(context.Background())
+			defer cancelOutbox()
+			go runOutboxPublisher(outboxCtx)
+		}
+	}
+
 	metrics.requestTime = prometheus.NewHistogramVec(prometheus.HistogramOpts{
 		Name: "prom_request_time",
 		Help: "Time it has taken to retrieve the metrics",
@@ -440,16 +659,32 @@ func main() {
 		log.Printf("Failed to register histogram: %v\n", err)
 	}
 
+	metrics.rateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "app",
+		Name:      "rate_limited_total",
+		Help:      "Count of /api/deposit and /api/withdraw requests rejected by the rate limiter",
+	}, []string{"endpoint", "user_id_bucket"})
+
+	if err := prometheus.Register(metrics.rateLimited); err != nil {
+		log.Printf("Failed to register rate limit counter: %v\n", err)
+	}
+
 	prometheus.MustRegister(metrics.counter)
 	prometheus.MustRegister(metrics.gauge)
 	prometheus.MustRegister(metrics.histogram)
 	prometheus.MustRegister(metrics.summary)
 
+	perMinute := envIntOrDefault("RATE_LIMIT_PER_MINUTE", rateLimitDefaultPerMinute)
+	burst := envIntOrDefault("RATE_LIMIT_BURST", rateLimitDefaultBurst)
+	rateLimiter = newTokenBucketLimiter(perMinute, burst)
+	log.Printf("Rate limiting: %d/min, burst %d\n", perMinute, burst)
+
 	go updateMetrics()
 
 	http.Handle("/metrics", newHandlerWithHistogram(promhttp.Handler(), metrics.requestTime))
-	http.HandleFunc("/api/deposit", depositHandler)
-	http.HandleFunc("/api/withdraw", withdrawHandler)
+	http.HandleFunc("/api/deposit", rateLimitMiddleware("/api/deposit", depositHandler))
+	http.HandleFunc("/api/withdraw", rateLimitMiddleware("/api/withdraw", withdrawHandler))
+	http.HandleFunc("/api/balance", balanceHandler)
 
 	serverPort := strconv.Itoa(port)
 	if envPort := os.Getenv("SERVER_PORT"); envPort != "" {
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+// outboxStreamName is the Redis Stream downstream services (fraud,
+// notifications, analytics) subscribe to for balance events.
+const outboxStreamName = "balance:events"
+
+// outboxPublishInterval is how often the background worker looks for
+// unpublished rows.
+const outboxPublishInterval = 500 * time.Millisecond
+
+// outboxBatchSize bounds how many rows the worker ships per tick.
+const outboxBatchSize = 100
+
+// outboxEventPayload is what gets JSON-encoded into outbox_events.payload and
+// later into the Redis Stream entry.
+type outboxEventPayload struct {
+	UserID        int     `json:"user_id"`
+	OperationType string  `json:"operation_type"`
+	Amount        float64 `json:"amount"`
+	Balance       float64 `json:"balance"`
+}
+
+// initOutboxTable creates the outbox_events table if it doesn't exist yet.
+// Rows are inserted in the same DB transaction as the ledger write so the
+// event can never be lost or duplicated relative to the balance change.
+func initOutboxTable() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var tableExists bool
+	err := db.QueryRowContext(ctx, `
+        SELECT EXISTS (
+            SELECT FROM information_schema.tables
+            WHERE table_schema = 'public'
+            AND table_name = 'outbox_events'
+        )
+    `).Scan(&tableExists)
+
+	if err != nil {
+		return fmt.Errorf("failed to check outbox_events table existence: %w", err)
+	}
+
+	if !tableExists {
+		log.Println("Creating outbox_events table...")
+
+		createTableSQL := `
+        CREATE TABLE outbox_events (
+            id SERIAL PRIMARY KEY,
+            event_id TEXT NOT NULL UNIQUE,
+            aggregate_id INTEGER NOT NULL,
+            payload JSONB NOT NULL,
+            created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            shipped_at TIMESTAMP
+        );
+
+        CREATE INDEX idx_outbox_events_unshipped ON outbox_events(id) WHERE shipped_at IS NULL;
+        `
+
+		_, err := db.ExecContext(ctx, createTableSQL)
+		if err != nil {
+			return fmt.Errorf("failed to create outbox_events table: %w", err)
+		}
+		log.Println("outbox_events table created")
+	} else {
+		log.Println("outbox_events table already exists")
+	}
+
+	return nil
+}
+
+// insertOutboxEvent records a balance-change event in the same DB
+// transaction as the ledger write. It's meant to be called from inside
+// applyLedgerEntry's dbTx.
+func insertOutboxEvent(ctx context.Context, dbTx *sql.Tx, userID int, operationType string, amount, balance float64) error {
+	payload, err := json.Marshal(outboxEventPayload{
+		UserID:        userID,
+		OperationType: operationType,
+		Amount:        amount,
+		Balance:       balance,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal outbox payload: %w", err)
+	}
+
+	if _, err := dbTx.ExecContext(ctx,
+		"INSERT INTO outbox_events (event_id, aggregate_id, payload) VALUES ($1, $2, $3)",
+		uuid.NewString(), userID, payload,
+	); err != nil {
+		return fmt.Errorf("failed to insert outbox event: %w", err)
+	}
+
+	return nil
+}
+
+// runOutboxPublisher polls outbox_events for unshipped rows and publishes
+// them to a Redis Stream via XADD, then marks them shipped. It runs until
+// ctx is cancelled and is meant to be started as a single background
+// goroutine from main.
+func runOutboxPublisher(ctx context.Context) {
+	ticker := time.NewTicker(outboxPublishInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := publishPendingOutboxEvents(ctx); err != nil {
+				log.Printf("outbox publisher error: %v\n", err)
+			}
+		}
+	}
+}
+
+func publishPendingOutboxEvents(ctx context.Context) error {
+	rows, err := db.QueryContext(ctx,
+		"SELECT id, event_id, aggregate_id, payload FROM outbox_events WHERE shipped_at IS NULL ORDER BY id LIMIT $1",
+		outboxBatchSize,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to query pending outbox events: %w", err)
+	}
+	defer rows.Close()
+
+	type pendingEvent struct {
+		id          int64
+		eventID     string
+		aggregateID int
+		payload     []byte
+	}
+
+	var pending []pendingEvent
+	for rows.Next() {
+		var ev pendingEvent
+		if err := rows.Scan(&ev.id, &ev.eventID, &ev.aggregateID, &ev.payload); err != nil {
+			return fmt.Errorf("failed to scan outbox event: %w", err)
+		}
+		pending = append(pending, ev)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to iterate outbox events: %w", err)
+	}
+
+	for _, ev := range pending {
+		_, err := redisClient.XAdd(ctx, &redis.XAddArgs{
+			Stream: outboxStreamName,
+			Values: map[string]interface{}{
+				"event_id":     ev.eventID,
+				"aggregate_id": ev.aggregateID,
+				"payload":      string(ev.payload),
+			},
+		}).Result()
+		if err != nil {
+			return fmt.Errorf("failed to publish outbox event %s: %w", ev.eventID, err)
+		}
+
+		if _, err := db.ExecContext(ctx,
+			"UPDATE outbox_events SET shipped_at = CURRENT_TIMESTAMP WHERE id = $1",
+			ev.id,
+		); err != nil {
+			return fmt.Errorf("failed to mark outbox event %s shipped: %w", ev.eventID, err)
+		}
+	}
+
+	return nil
+}
+
+// OutboxConsumer is a thin wrapper around a Redis Streams consumer group,
+// so downstream services (fraud, notifications, analytics) can subscribe to
+// balance:events reliably and resume after a restart.
+type OutboxConsumer struct {
+	client   redis.UniversalClient
+	stream   string
+	group    string
+	consumer string
+}
+
+// NewOutboxConsumer creates the consumer group (if it doesn't exist yet) and
+// returns a consumer bound to it.
+func NewOutboxConsumer(ctx context.Context, client redis.UniversalClient, group, consumer string) (*OutboxConsumer, error) {
+	err := client.XGroupCreateMkStream(ctx, outboxStreamName, group, "0").Err()
+	if err != nil && !errors.Is(err, redis.Nil) && err.Error() != "BUSYGROUP Consumer Group name already exists" {
+		return nil, fmt.Errorf("failed to create consumer group %s: %w", group, err)
+	}
+
+	return &OutboxConsumer{
+		client:   client,
+		stream:   outboxStreamName,
+		group:    group,
+		consumer: consumer,
+	}, nil
+}
+
+// ReadEvents blocks up to block for up to count new stream entries using
+// XREADGROUP.
+func (c *OutboxConsumer) ReadEvents(ctx context.Context, count int64, block time.Duration) ([]redis.XMessage, error) {
+	streams, err := c.client.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    c.group,
+		Consumer: c.consumer,
+		Streams:  []string{c.stream, ">"},
+		Count:    count,
+		Block:    block,
+	}).Result()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from consumer group %s: %w", c.group, err)
+	}
+
+	if len(streams) == 0 {
+		return nil, nil
+	}
+	return streams[0].Messages, nil
+}
+
+// Ack acknowledges processed message IDs so they aren't redelivered.
+func (c *OutboxConsumer) Ack(ctx context.Context, ids ...string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	if err := c.client.XAck(ctx, c.stream, c.group, ids...).Err(); err != nil {
+		return fmt.Errorf("failed to ack messages on group %s: %w", c.group, err)
+	}
+	return nil
+}
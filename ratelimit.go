@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/time/rate"
+)
+
+// rateLimitDefaultPerMinute and rateLimitDefaultBurst are used when
+// RATE_LIMIT_PER_MINUTE / RATE_LIMIT_BURST aren't set.
+const (
+	rateLimitDefaultPerMinute = 60
+	rateLimitDefaultBurst     = 10
+)
+
+// rateLimiterCacheCapacity bounds the in-process fallback cache, same way
+// idempotencyCacheCapacity bounds localIdempotencyCache.
+const rateLimiterCacheCapacity = 10000
+
+// rateLimitBucketSize groups user IDs into ranges for the
+// app_rate_limited_total user_id_bucket label, so the metric's cardinality
+// stays bounded regardless of how many distinct users get throttled.
+const rateLimitBucketSize = 1000
+
+// rateLimiter is the global token-bucket limiter used by rateLimitMiddleware,
+// backed by Redis when redisEnabled and by an in-process fallback otherwise.
+var rateLimiter *tokenBucketLimiter
+
+// tokenBucketScript implements an atomic token-bucket refill + consume in
+// Redis: it reads the bucket's current tokens and last-refill timestamp,
+// refills based on elapsed time, and consumes one token if available, all
+// in a single round trip so concurrent requests can't race each other's
+// refill math.
+var tokenBucketScript = redis.NewScript(`
+local key = KEYS[1]
+local capacity = tonumber(ARGV[1])
+local refill_per_sec = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local requested = tonumber(ARGV[4])
+
+local bucket = redis.call("HMGET", key, "tokens", "ts")
+local tokens = tonumber(bucket[1])
+local last = tonumber(bucket[2])
+
+if tokens == nil then
+    tokens = capacity
+    last = now
+end
+
+local elapsed = now - last
+if elapsed < 0 then
+    elapsed = 0
+end
+tokens = math.min(capacity, tokens + elapsed * refill_per_sec)
+
+local allowed = 0
+if tokens >= requested then
+    tokens = tokens - requested
+    allowed = 1
+end
+
+redis.call("HSET", key, "tokens", tokens, "ts", now)
+redis.call("EXPIRE", key, 3600)
+
+return {allowed, tokens}
+`)
+
+// tokenBucketLimiter rate-limits by key (user ID or IP) using a token bucket
+// with perMinute refill and burst capacity. It's Redis-backed when redis is
+// initialized; otherwise it falls back to local, an in-process LRU of
+// golang.org/x/time/rate limiters.
+type tokenBucketLimiter struct {
+	perMinute int
+	burst     int
+	local     *localRateLimiterCache
+}
+
+// newTokenBucketLimiter builds a limiter for the given rate. When
+// redisEnabled is false it allocates the in-process fallback cache;
+// otherwise Allow talks to Redis via tokenBucketScript. A zero perMinute
+// (e.g. a misconfigured RATE_LIMIT_PER_MINUTE=0) would make Allow divide by
+// zero and a non-positive burst would leave no tokens for any request, so
+// non-positive values of either fall back to the package defaults.
+func newTokenBucketLimiter(perMinute, burst int) *tokenBucketLimiter {
+	if perMinute <= 0 {
+		perMinute = rateLimitDefaultPerMinute
+	}
+	if burst <= 0 {
+		burst = rateLimitDefaultBurst
+	}
+	tb := &tokenBucketLimiter{perMinute: perMinute, burst: burst}
+	if !redisEnabled {
+		tb.local = newLocalRateLimiterCache(rateLimiterCacheCapacity, perMinute, burst)
+	}
+	return tb
+}
+
+// Allow reports whether the caller identified by key may proceed. On
+// rejection it also returns how long the caller should wait before retrying.
+// Redis errors fail open (allowed=true) since a rate limiter outage
+// shouldn't take deposits/withdrawals down with it; the caller is
+// responsible for logging the error.
+func (tb *tokenBucketLimiter) Allow(ctx context.Context, key string) (bool, time.Duration, error) {
+	refillPerSec := float64(tb.perMinute) / 60.0
+	retryAfter := time.Duration(float64(time.Second) / refillPerSec)
+
+	if tb.local != nil {
+		if tb.local.allow(key) {
+			return true, 0, nil
+		}
+		return false, retryAfter, nil
+	}
+
+	now := float64(time.Now().UnixNano()) / float64(time.Second)
+	res, err := tokenBucketScript.Run(ctx, redisClient, []string{key}, tb.burst, refillPerSec, now, 1).Result()
+	if err != nil {
+		return true, 0, fmt.Errorf("rate limit check failed: %w", err)
+	}
+
+	vals, ok := res.([]interface{})
+	if !ok || len(vals) != 2 {
+		return true, 0, fmt.Errorf("unexpected rate limit script result: %v", res)
+	}
+	allowed, _ := vals[0].(int64)
+	if allowed == 1 {
+		return true, 0, nil
+	}
+	return false, retryAfter, nil
+}
+
+// localRateLimiterEntry is one bucket in localRateLimiterCache.
+type localRateLimiterEntry struct {
+	key     string
+	limiter *rate.Limiter
+}
+
+// localRateLimiterCache is an LRU of per-key rate.Limiters, used in place of
+// Redis when redisEnabled == false. It evicts the least-recently-used bucket
+// once capacity is exceeded so idle users don't pin memory forever, the same
+// way localIdempotencyCache does for replay records.
+type localRateLimiterCache struct {
+	mu       sync.Mutex
+	capacity int
+	perMin   int
+	burst    int
+	ll       *list.List
+	items    map[string]*list.Element
+}
+
+func newLocalRateLimiterCache(capacity, perMin, burst int) *localRateLimiterCache {
+	return &localRateLimiterCache{
+		capacity: capacity,
+		perMin:   perMin,
+		burst:    burst,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+func (c *localRateLimiterCache) allow(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var entry *localRateLimiterEntry
+	if el, ok := c.items[key]; ok {
+		entry = el.Value.(*localRateLimiterEntry)
+		c.ll.MoveToFront(el)
+	} else {
+		entry = &localRateLimiterEntry{
+			key:     key,
+			limiter: rate.NewLimiter(rate.Limit(float64(c.perMin)/60.0), c.burst),
+		}
+		el := c.ll.PushFront(entry)
+		c.items[key] = el
+
+		for c.ll.Len() > c.capacity {
+			oldest := c.ll.Back()
+			if oldest == nil {
+				break
+			}
+			c.ll.Remove(oldest)
+			delete(c.items, oldest.Value.(*localRateLimiterEntry).key)
+		}
+	}
+
+	return entry.limiter.Allow()
+}
+
+// userIDBucket groups a user ID into a fixed-width range so the
+// user_id_bucket metric label has bounded cardinality (one series per
+// rateLimitBucketSize users instead of one per user).
+func userIDBucket(userID int) string {
+	if userID < 0 {
+		userID = 0
+	}
+	lo := (userID / rateLimitBucketSize) * rateLimitBucketSize
+	return fmt.Sprintf("%d-%d", lo, lo+rateLimitBucketSize-1)
+}
+
+// clientIP extracts the request's IP, stripping the port, for use as a
+// rate-limit key when the request can't be attributed to a user ID.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// rateLimitMiddleware wraps a deposit/withdraw handler with a token-bucket
+// check keyed by user_id, falling back to the client IP when the body
+// doesn't carry a usable user ID (e.g. it's malformed; the wrapped handler
+// will reject it with its own 400 either way). On exceeding the limit it
+// responds 429 with Retry-After and counts the rejection in
+// app_rate_limited_total.
+func rateLimitMiddleware(endpoint string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || rateLimiter == nil {
+			next(w, r)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		var tx Transaction
+		_ = json.Unmarshal(body, &tx)
+
+		key := fmt.Sprintf("ratelimit:%s:user:%d", endpoint, tx.UserID)
+		if tx.UserID == 0 {
+			key = fmt.Sprintf("ratelimit:%s:ip:%s", endpoint, clientIP(r))
+		}
+
+		allowed, retryAfter, err := rateLimiter.Allow(r.Context(), key)
+		if err != nil {
+			// depositHandler/withdrawHandler attach auditContext via
+			// withAuditContext themselves, but that hasn't happened yet at
+			// this point in the middleware chain — build it here from what's
+			// already in scope so the event still carries endpoint and
+			// correlation ID instead of a zero-value auditContext.
+			ac := auditContext{CorrelationID: requestCorrelationID(r), Endpoint: endpoint, UserID: tx.UserID}
+			emitHandlerAuditEvent(withAuditContext(r.Context(), ac), tx.UserID, "rate_limit_error", err)
+		}
+		if !allowed {
+			metrics.rateLimited.WithLabelValues(endpoint, userIDBucket(tx.UserID)).Inc()
+			w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds()+1)))
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// envIntOrDefault reads name as an int, falling back to def when unset or
+// unparsable.
+func envIntOrDefault(name string, def int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return def
+	}
+	return n
+}
@@ -0,0 +1,85 @@
+package main
+
+import "testing"
+
+func TestNewTokenBucketLimiterClampsNonPositiveValues(t *testing.T) {
+	tb := newTokenBucketLimiter(0, 0)
+	if tb.perMinute != rateLimitDefaultPerMinute {
+		t.Fatalf("expected perMinute to fall back to default %d, got %d", rateLimitDefaultPerMinute, tb.perMinute)
+	}
+	if tb.burst != rateLimitDefaultBurst {
+		t.Fatalf("expected burst to fall back to default %d, got %d", rateLimitDefaultBurst, tb.burst)
+	}
+
+	tb = newTokenBucketLimiter(-5, -1)
+	if tb.perMinute != rateLimitDefaultPerMinute || tb.burst != rateLimitDefaultBurst {
+		t.Fatalf("expected negative values to fall back to defaults, got perMinute=%d burst=%d", tb.perMinute, tb.burst)
+	}
+}
+
+func TestTokenBucketLimiterAllowDoesNotDivideByZero(t *testing.T) {
+	tb := newTokenBucketLimiter(0, 1)
+
+	// Exhaust the single-token burst so Allow takes the reject path and
+	// computes retryAfter; a perMinute of 0 reaching refillPerSec would make
+	// this a division by zero producing +Inf/garbage duration.
+	allowed, _, err := tb.Allow(nil, "user")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !allowed {
+		t.Fatalf("expected first request to be allowed")
+	}
+
+	allowed, retryAfter, err := tb.Allow(nil, "user")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if allowed {
+		t.Fatalf("expected second request to be rejected")
+	}
+	if retryAfter <= 0 {
+		t.Fatalf("expected a positive, finite retryAfter, got %v", retryAfter)
+	}
+}
+
+func TestLocalRateLimiterCacheEvictsOldestOverCapacity(t *testing.T) {
+	c := newLocalRateLimiterCache(2, rateLimitDefaultPerMinute, rateLimitDefaultBurst)
+
+	c.allow("a")
+	c.allow("b")
+	c.allow("c") // evicts "a", the least recently used key
+
+	if _, ok := c.items["a"]; ok {
+		t.Fatalf("expected \"a\" to be evicted once capacity was exceeded")
+	}
+	if _, ok := c.items["b"]; !ok {
+		t.Fatalf("expected \"b\" to still be cached")
+	}
+	if _, ok := c.items["c"]; !ok {
+		t.Fatalf("expected \"c\" to still be cached")
+	}
+}
+
+func TestLocalRateLimiterCacheEnforcesBurst(t *testing.T) {
+	c := newLocalRateLimiterCache(10, rateLimitDefaultPerMinute, 1)
+
+	if !c.allow("user") {
+		t.Fatalf("expected first request within burst to be allowed")
+	}
+	if c.allow("user") {
+		t.Fatalf("expected second immediate request to exceed burst of 1 and be rejected")
+	}
+}
+
+func TestUserIDBucketGroupsIntoFixedRanges(t *testing.T) {
+	if got := userIDBucket(-1); got != "0-999" {
+		t.Fatalf("expected negative user IDs to clamp into the first bucket, got %q", got)
+	}
+	if got := userIDBucket(0); got != "0-999" {
+		t.Fatalf("expected bucket \"0-999\", got %q", got)
+	}
+	if got := userIDBucket(1500); got != "1000-1999" {
+		t.Fatalf("expected bucket \"1000-1999\", got %q", got)
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
 	"os"
 	"time"
@@ -85,11 +84,24 @@ func (zn *ZAPNotifier) NotifyRaceConditionPrevented(userID int, endpoint, method
 		}
 	}
 
+	correlationID, _ := metadata["correlation_id"].(string)
+
 	go func() {
+		event := AuditEvent{
+			Timestamp:     time.Now(),
+			CorrelationID: correlationID,
+			UserID:        userID,
+			Endpoint:      endpoint,
+			Outcome:       "zap_notified",
+		}
+
 		if err := zn.sendAlert(alert); err != nil {
-			log.Printf("Failed to send ZAP alert: %v", err)
-		} else {
-			log.Printf("ZAP notified about prevented race condition for user %d", userID)
+			event.Outcome = "zap_notify_failed"
+			event.Detail = err.Error()
+		}
+
+		if auditLogger != nil {
+			auditLogger.Log(event)
 		}
 	}()
 }
@@ -161,8 +173,16 @@ func (zn *ZAPNotifier) sendToZAPLogger(alert ZAPAlert) error {
 
 	resp, err := zn.httpClient.Do(req)
 	if err != nil {
-		// Last resort: log to stdout in structured format
-		log.Printf("ZAP_ALERT: %+v", alert)
+		// Last resort: fall back to the structured audit trail.
+		if auditLogger != nil {
+			auditLogger.Log(AuditEvent{
+				Timestamp: time.Now(),
+				UserID:    alert.UserID,
+				Endpoint:  alert.URL,
+				Outcome:   "zap_alert_fallback",
+				Detail:    fmt.Sprintf("%+v", alert),
+			})
+		}
 		return err
 	}
 	defer resp.Body.Close()